@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ContentDirName = "content"
+const DateDirName = "date"
+
+// DupError indicates that a file's content hash already existed in the
+// content-addressed store. The copy itself was skipped, but a date link
+// was still created, so callers can log it and move on instead of
+// treating it as a failure.
+type DupError struct {
+	Path string
+}
+
+func (e *DupError) Error() string {
+	return fmt.Sprintf("duplicate content, reused existing blob for %s", e.Path)
+}
+
+// PrepOutput creates the 256 hash-shard directories under <outDir>/content
+// and the <outDir>/date directory up front, so copyFileContentAddressed
+// never has to check for its parent directory on every file.
+func PrepOutput(outDir string) error {
+	for i := 0; i < 256; i++ {
+		shard := fmt.Sprintf("%02x", i)
+		if err := os.MkdirAll(path.Join(outDir, ContentDirName, shard), 0777); err != nil {
+			return fmt.Errorf("create content shard directory %s: %v", shard, err)
+		}
+	}
+
+	if err := os.MkdirAll(path.Join(outDir, DateDirName), 0777); err != nil {
+		return fmt.Errorf("create date directory: %v", err)
+	}
+
+	return nil
+}
+
+// contentAddressedPlan is the path/hash information copyFileContentAddressed
+// needs to actually place a file, split out so -dryrun can compute and
+// report it without touching the filesystem.
+type contentAddressedPlan struct {
+	hash        string
+	contentPath string
+	datePath    string
+	isDup       bool
+}
+
+// planContentAddressedPath hashes the file at sourceDir/fileInfo.Name()
+// and works out where it would land in the content-addressed store,
+// without writing or linking anything.
+func planContentAddressedPath(fileInfo fs.FileInfo, sourceDir string, outDir string, dateTaken time.Time) (contentAddressedPlan, error) {
+	fileName := fileInfo.Name()
+	srcPath := path.Join(sourceDir, fileName)
+	ext := strings.ToLower(filepath.Ext(fileName))
+
+	hash, err := hashFile(srcPath)
+	if err != nil {
+		return contentAddressedPlan{}, fmt.Errorf("hash file %s: %v", fileName, err)
+	}
+
+	contentPath := path.Join(outDir, ContentDirName, hash[:2], hash[2:]+ext)
+	isDup := FileExists(contentPath)
+
+	dateDir := path.Join(outDir, DateDirName, fmt.Sprintf("%d", dateTaken.Year()), fmt.Sprintf("%02d", dateTaken.Month()))
+	datePath := uniqueDatePath(dateDir, dateTaken, ext)
+
+	return contentAddressedPlan{hash: hash, contentPath: contentPath, datePath: datePath, isDup: isDup}, nil
+}
+
+// copyFileContentAddressed writes fileInfo once into a content-addressed
+// store keyed by its hash, at <outDir>/content/<hh>/<rest-of-hash><ext>,
+// then links it into <outDir>/date/YYYY/MM/<unix-nano><ext> so the store
+// stays deduplicated while still being browsable by date. If the content
+// already exists, the copy is skipped and a *DupError is returned
+// alongside the date path that was created for it.
+func copyFileContentAddressed(fileInfo fs.FileInfo, sourceDir string, outDir string, dateTaken time.Time) (string, error) {
+	fileName := fileInfo.Name()
+	srcPath := path.Join(sourceDir, fileName)
+
+	plan, err := planContentAddressedPath(fileInfo, sourceDir, outDir, dateTaken)
+	if err != nil {
+		return "", err
+	}
+
+	if !plan.isDup {
+		fileContent, err := os.ReadFile(srcPath)
+		if err != nil {
+			return "", fmt.Errorf("read file %s: %v", fileName, err)
+		}
+
+		if err := os.WriteFile(plan.contentPath, fileContent, 0644); err != nil {
+			return "", fmt.Errorf("write content blob %s: %v", plan.contentPath, err)
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(plan.datePath), 0777); err != nil {
+		return "", fmt.Errorf("create date directory %s: %v", path.Dir(plan.datePath), err)
+	}
+
+	if err := linkFile(plan.contentPath, plan.datePath); err != nil {
+		return "", fmt.Errorf("link %s to %s: %v", plan.contentPath, plan.datePath, err)
+	}
+
+	if plan.isDup {
+		return plan.datePath, &DupError{Path: srcPath}
+	}
+
+	return plan.datePath, nil
+}
+
+// hashFile returns the hex-encoded MD5 digest of the file at filePath.
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("open file %s: %v", filePath, err)
+	}
+	defer file.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("hash file %s: %v", filePath, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// claimedDatePaths tracks, for this run, which date paths have already
+// been handed out by uniqueDatePath, so two files whose EXIF dates land
+// in the same second (EXIF DateTime is only second-resolution) don't
+// race each other onto the same <unix-nano><ext> path before either has
+// actually been linked.
+var claimedDatePaths = struct {
+	sync.Mutex
+	claimed map[string]bool
+}{claimed: map[string]bool{}}
+
+// uniqueDatePath builds <dateDir>/<unix-nano><ext>, appending a _NNNN
+// suffix if several files happen to share the same timestamp.
+func uniqueDatePath(dateDir string, t time.Time, ext string) string {
+	base := fmt.Sprintf("%d", t.UnixNano())
+
+	claimedDatePaths.Lock()
+	defer claimedDatePaths.Unlock()
+
+	candidate := path.Join(dateDir, base+ext)
+	for n := 1; claimedDatePaths.claimed[candidate] || FileExists(candidate); n++ {
+		candidate = path.Join(dateDir, fmt.Sprintf("%s_%04d%s", base, n, ext))
+	}
+
+	claimedDatePaths.claimed[candidate] = true
+	return candidate
+}
+
+// linkFile hardlinks dst to src, falling back to a symlink if the hardlink
+// fails, e.g. because src and dst are on different filesystems. A symlink
+// target is resolved relative to dst's directory, not the process's CWD,
+// so src is made absolute first.
+func linkFile(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	absSrc, err := filepath.Abs(src)
+	if err != nil {
+		return fmt.Errorf("resolve absolute path for %s: %v", src, err)
+	}
+
+	return os.Symlink(absSrc, dst)
+}
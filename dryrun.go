@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+)
+
+// ManifestEntry records one planned move from a -dryrun pass, in enough
+// detail that -apply can replay it later without re-scanning the source
+// tree.
+type ManifestEntry struct {
+	Source     string `json:"source"`
+	Target     string `json:"target"`
+	DateSource string `json:"date_source"`
+	Category   string `json:"category"`
+	Size       int64  `json:"size"`
+	Hash       string `json:"hash"`
+	// ContentPath and IsDup are only set for a content-addressed plan, so
+	// -apply can recreate the content/ blob and date/ link the real run
+	// would have made instead of falling back to a loose copy at Target.
+	ContentPath string `json:"content_path,omitempty"`
+	IsDup       bool   `json:"is_dup,omitempty"`
+}
+
+// manifestRecorder collects ManifestEntry values from concurrent Move
+// workers during a -dryrun pass.
+type manifestRecorder struct {
+	mu      sync.Mutex
+	entries []ManifestEntry
+}
+
+func (r *manifestRecorder) add(e ManifestEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, e)
+}
+
+// writeTo marshals the recorded entries as indented JSON and writes them
+// to path.
+func (r *manifestRecorder) writeTo(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := json.MarshalIndent(r.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %v", err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("write manifest %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// planMove resolves the same target path Move would write to, without
+// touching the filesystem, logs it as "SRC -> DST", and records it on
+// m.manifest if one was configured.
+func (m baseMedia) planMove(outDir string) error {
+	fileName := m.info.Name()
+
+	var outPath string
+	var contentPath string
+	var isDup bool
+	var hash string
+	var err error
+	switch {
+	case m.contentAddressed:
+		var plan contentAddressedPlan
+		plan, err = planContentAddressedPath(m.info, m.sourceDir, outDir, m.dateTaken)
+		outPath = plan.datePath
+		contentPath = plan.contentPath
+		isDup = plan.isDup
+		hash = plan.hash
+	case m.template != "":
+		outPath, err = planTemplatePath(m.sourceDir, fileName, outDir, m.template, m.category, m.dateTaken)
+	default:
+		outPath, err = resolveOutPath(m.info, outDir, m.sortIntoCategories, m.dateTaken, m.category, true)
+	}
+
+	if err != nil {
+		return fmt.Errorf("plan move for %s: %v", fileName, err)
+	}
+
+	log.Printf("%s -> %s", m.path, outPath)
+
+	if m.manifest != nil {
+		if hash == "" {
+			hash, err = hashFile(m.path)
+			if err != nil {
+				return fmt.Errorf("hash file %s: %v", fileName, err)
+			}
+		}
+
+		m.manifest.add(ManifestEntry{
+			Source:      m.path,
+			Target:      outPath,
+			DateSource:  m.dateSource,
+			Category:    m.category,
+			Size:        m.info.Size(),
+			Hash:        hash,
+			ContentPath: contentPath,
+			IsDup:       isDup,
+		})
+	}
+
+	return nil
+}
+
+// applyManifest replays a manifest written by a previous -dryrun
+// -manifest pass, without re-scanning or re-resolving dates. Entries from
+// a -contentaddr run recreate the content/ blob and date/ link; all
+// others are copied straight from Source to Target.
+func applyManifest(manifestPath string) error {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return fmt.Errorf("read manifest %s: %v", manifestPath, err)
+	}
+
+	var entries []ManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("parse manifest %s: %v", manifestPath, err)
+	}
+
+	errCount := 0
+	for _, entry := range entries {
+		if err := applyManifestEntry(entry); err != nil {
+			log.Printf("ERROR: apply %s -> %s: %v", entry.Source, entry.Target, err)
+			errCount++
+			continue
+		}
+		log.Printf("applied %s -> %s", entry.Source, entry.Target)
+	}
+
+	if errCount > 0 {
+		return fmt.Errorf("%d manifest entries failed to apply, see log for details", errCount)
+	}
+
+	return nil
+}
+
+func applyManifestEntry(entry ManifestEntry) error {
+	if entry.ContentPath != "" {
+		return applyContentAddressedManifestEntry(entry)
+	}
+
+	if err := os.MkdirAll(path.Dir(entry.Target), 0777); err != nil {
+		return fmt.Errorf("create target directory for %s: %v", entry.Target, err)
+	}
+
+	fileContent, err := os.ReadFile(entry.Source)
+	if err != nil {
+		return fmt.Errorf("read source %s: %v", entry.Source, err)
+	}
+
+	if err := os.WriteFile(entry.Target, fileContent, 0644); err != nil {
+		return fmt.Errorf("write target %s: %v", entry.Target, err)
+	}
+
+	return nil
+}
+
+// applyContentAddressedManifestEntry replays an entry recorded from a
+// -contentaddr -dryrun pass: it writes the content blob at ContentPath
+// (unless it was a dup, or another applied entry already wrote it), then
+// links Target to it, the same way copyFileContentAddressed would.
+func applyContentAddressedManifestEntry(entry ManifestEntry) error {
+	if !entry.IsDup {
+		if err := os.MkdirAll(path.Dir(entry.ContentPath), 0777); err != nil {
+			return fmt.Errorf("create content directory for %s: %v", entry.ContentPath, err)
+		}
+
+		if !FileExists(entry.ContentPath) {
+			fileContent, err := os.ReadFile(entry.Source)
+			if err != nil {
+				return fmt.Errorf("read source %s: %v", entry.Source, err)
+			}
+
+			if err := os.WriteFile(entry.ContentPath, fileContent, 0644); err != nil {
+				return fmt.Errorf("write content blob %s: %v", entry.ContentPath, err)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(entry.Target), 0777); err != nil {
+		return fmt.Errorf("create target directory for %s: %v", entry.Target, err)
+	}
+
+	if err := linkFile(entry.ContentPath, entry.Target); err != nil {
+		return fmt.Errorf("link %s to %s: %v", entry.ContentPath, entry.Target, err)
+	}
+
+	return nil
+}
+
+// limiter bounds how many Media values Parse will emit across all of its
+// workers, so -limit can cap a -dryrun preview's length.
+type limiter struct {
+	mu  sync.Mutex
+	max int
+	n   int
+}
+
+// allow reports whether another item may be emitted. A nil limiter or a
+// non-positive max means unlimited.
+func (l *limiter) allow() bool {
+	if l == nil || l.max <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.n >= l.max {
+		return false
+	}
+	l.n++
+	return true
+}
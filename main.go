@@ -10,10 +10,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
+	"regexp"
 	"strings"
-	"sync"
-	"syscall"
 	"time"
 )
 
@@ -23,26 +21,55 @@ const (
 	GifsDirName     = "gifs"
 )
 
-var pictureFileExtensions = []string{".jpg", ".png", ".heic", ".jpeg", ".dng", ".arw"}
-var videoFileExtensions = []string{".mp4", ".mov", ".webp"}
-var gifFileExtensions = []string{".gif"}
-var fileDateTimeFormats = []string{
-	"2006-01-02_15-04-05",
-	"2006-01-02",
-	"20060102",
-	"20060102_150405",
-	"20060102_150405",
-	"PXL_20060102_150405",
+// fileNameDatePatterns maps a regex matching an embedded timestamp
+// substring to the Go reference layout that parses it. They're checked in
+// order, and only the matched substring is parsed, not the whole
+// filename, so e.g. "IMG_20230515_142530.jpg" or
+// "Screenshot 2023-05-15 14.30.25.png" both resolve correctly.
+var fileNameDatePatterns = []struct {
+	pattern   *regexp.Regexp
+	layout    string
+	normalize func(string) string // optional: massage the matched substring before parsing
+}{
+	{pattern: regexp.MustCompile(`PXL_\d{8}_\d{9}`), layout: "PXL_20060102_150405"},
+	{pattern: regexp.MustCompile(`\d{8}_\d{6}`), layout: "20060102_150405"},
+	{
+		pattern: regexp.MustCompile(`\d{4}-\d{2}-\d{2}[ _]\d{2}[.:-]\d{2}[.:-]\d{2}`),
+		layout:  "2006-01-02 15.04.05",
+		normalize: func(s string) string {
+			datePart, timePart, _ := strings.Cut(s, " ")
+			if timePart == "" {
+				datePart, timePart, _ = strings.Cut(s, "_")
+			}
+			timePart = strings.NewReplacer(":", ".", "-", ".").Replace(timePart)
+			return datePart + " " + timePart
+		},
+	},
+	{pattern: regexp.MustCompile(`\d{4}-\d{2}-\d{2}`), layout: "2006-01-02"},
+	{pattern: regexp.MustCompile(`\d{8}`), layout: "20060102"},
 }
 
 var sourceDirArg = flag.String("source", "", "Source directory")
 var outDirArg = flag.String("out", "", "Output directory")
 var fileExtensionsArg = flag.String("ext", "*", "File extensions to sort, comma separated with no spaces: \".jpg,.png\" and so on. Leave empty or '*' to sort all files")
 var sortCategoriesArg = flag.Bool("categories", true, "Sort files into categories (pictures, videos)")
+var contentAddressedArg = flag.Bool("contentaddr", false, "Store files in a deduplicated, hash-addressed content/ layout with a browsable date/ tree of links alongside it")
+var templateArg = flag.String("template", "", "Output path template using strftime-style tokens (%Y %y %m %d %H %M %S) plus %category, %ext, %name and %hash, e.g. \"%Y/%m/%d-%H%M%S\". Leave empty to use the default YYYY-MM/<category>/filename layout")
+var dryRunArg = flag.Bool("dryrun", false, "Preview the sort plan without copying, linking or creating any files")
+var manifestArg = flag.String("manifest", "", "With -dryrun, write the planned moves as a JSON manifest to this path")
+var limitArg = flag.Int("limit", 0, "With -dryrun, stop previewing after this many files. 0 means unlimited")
+var applyArg = flag.String("apply", "", "Apply a manifest written by a previous -dryrun -manifest run, without re-scanning the source directory")
 
 func main() {
 	flag.Parse()
 
+	if applyArg != nil && *applyArg != "" {
+		if err := applyManifest(*applyArg); err != nil {
+			log.Fatalf("failed to apply manifest: %v", err)
+		}
+		return
+	}
+
 	if sourceDirArg == nil {
 		log.Fatal("source directory not specified")
 	}
@@ -55,8 +82,12 @@ func main() {
 		log.Fatal("out directory not specified")
 	}
 
-	if err := createDirIfNotExists(*outDirArg); err != nil {
-		log.Fatalf("failed to create out directory %s: %v", *outDirArg, err)
+	dryRun := dryRunArg != nil && *dryRunArg
+
+	if !dryRun {
+		if err := createDirIfNotExists(*outDirArg); err != nil {
+			log.Fatalf("failed to create out directory %s: %v", *outDirArg, err)
+		}
 	}
 
 	fileExtensions := resolveFileExtensions()
@@ -66,149 +97,151 @@ func main() {
 		sortCategories = *sortCategoriesArg
 	}
 
-	if err := sortFiles(*sourceDirArg, *outDirArg, fileExtensions, sortCategories); err != nil {
-		log.Fatalf("failed to sort files: %v", err)
+	contentAddressed := contentAddressedArg != nil && *contentAddressedArg
+	if contentAddressed && !dryRun {
+		if err := PrepOutput(*outDirArg); err != nil {
+			log.Fatalf("failed to prep out directory %s: %v", *outDirArg, err)
+		}
 	}
-}
 
-func sortFiles(sourceDir string, outDir string, fileExtensions []string, sortIntoCategories bool) error {
-	items, err := os.ReadDir(sourceDir)
-	if err != nil {
-		return fmt.Errorf("read source dir %s: %v", sourceDir, err)
-	}
-
-	fileChan := make(chan fs.DirEntry)
-	var wg sync.WaitGroup
-
-	// Start worker goroutines for each CPU core
-	numWorkers := runtime.NumCPU()
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-
-		go func() {
-			defer wg.Done()
-
-			// Process files from the channel
-			for item := range fileChan {
-				if item.IsDir() {
-					continue
-				}
-
-				fileName := item.Name()
-				fileInfo, err := item.Info()
-				if err != nil {
-					log.Printf("ERROR: get file info for %s: %v", fileName, err)
-					continue
-				}
-
-				if !shouldBeSorted(fileName, fileExtensions) {
-					log.Printf("file %s does not match allowed file extensions %+v, skipping", fileName, fileExtensions)
-					continue
-				}
-
-				log.Printf("copying file %s", fileName)
-				outPath, err := copyFile(fileInfo, sourceDir, outDir, sortIntoCategories)
-				if err != nil {
-					log.Printf("ERROR: copy file %s: %v", fileName, err)
-					continue
-				}
-
-				if err := preserveOriginalFileCreationDate(fileInfo, outPath); err != nil {
-					log.Printf("ERROR: preserve original file creation date: %v", err)
-				}
-
-				log.Printf("file %s copied to %s", fileName, outPath)
-			}
-		}()
+	template := ""
+	if templateArg != nil {
+		template = *templateArg
 	}
 
-	// Send files to be processed by each worker
-	for _, item := range items {
-		fileChan <- item
+	limit := 0
+	if dryRun && limitArg != nil {
+		limit = *limitArg
 	}
-	close(fileChan)
 
-	// Wait for all workers to finish
-	wg.Wait()
+	var manifest *manifestRecorder
+	if dryRun && manifestArg != nil && *manifestArg != "" {
+		manifest = &manifestRecorder{}
+	}
 
-	return nil
-}
+	opts := parseMediaOptions{
+		sortIntoCategories: sortCategories,
+		contentAddressed:   contentAddressed,
+		template:           template,
+		dryRun:             dryRun,
+		manifest:           manifest,
+	}
 
-func copyFile(fileInfo fs.FileInfo, sourceDir string, outDir string, sortIntoCategories bool) (string, error) {
-	fileName := fileInfo.Name()
+	if err := sortFiles(*sourceDirArg, *outDirArg, fileExtensions, opts, limit); err != nil {
+		log.Fatalf("failed to sort files: %v", err)
+	}
 
-	// Get the date when the file was created (ideally when the picture was taken)
-	fileCreationDate := getFileCreatedDateTime(fileInfo, sourceDir)
+	if manifest != nil {
+		if err := manifest.writeTo(*manifestArg); err != nil {
+			log.Fatalf("failed to write manifest %s: %v", *manifestArg, err)
+		}
+	}
+}
 
-	// Use the year and month to sort the files into subdirectories
-	fileCreationYear := fileCreationDate.Year()
-	fileCreationMonth := fileCreationDate.Month()
-	fileCreationDay := fileCreationDate.Day()
+// sortFiles drives the Source -> Parse -> Move pipeline: it walks
+// sourceDir recursively, parses each candidate file into a Media value,
+// and moves the results into outDir, aggregating any per-file errors into
+// a single summary error. limit, if greater than 0, caps how many files
+// are processed.
+func sortFiles(sourceDir string, outDir string, fileExtensions []string, opts parseMediaOptions, limit int) error {
+	inside, err := dirContains(sourceDir, outDir)
+	if err != nil {
+		return fmt.Errorf("resolve source/out directories: %v", err)
+	}
+	if inside {
+		return fmt.Errorf("out directory %s is inside source directory %s, the recursive walk would re-ingest its own output", outDir, sourceDir)
+	}
 
-	log.Printf("file %s created on %d-%02d-%02d", fileName, fileCreationYear, fileCreationMonth, fileCreationDay)
+	paths := Source(sourceDir)
+	media := Parse(paths, fileExtensions, opts, &limiter{max: limit})
+	errs := Move(media, outDir)
 
-	// Put files into subdirectories on the format YYYY-MM
-	monthDir := path.Join(outDir, fmt.Sprintf("%d-%02d", fileCreationYear, fileCreationMonth))
-	if err := createDirIfNotExists(monthDir); err != nil {
-		return "", fmt.Errorf("create month directory %s: %v", monthDir, err)
+	errCount := 0
+	for err := range errs {
+		log.Printf("ERROR: %v", err)
+		errCount++
+	}
+
+	if errCount > 0 {
+		return fmt.Errorf("%d file(s) failed to sort, see log for details", errCount)
 	}
 
-	outPath, err := constructOutPath(monthDir, fileName, sortIntoCategories)
+	return nil
+}
+
+func copyFile(fileInfo fs.FileInfo, sourceDir string, outDir string, sortIntoCategories bool, dateTaken time.Time, category string) (string, error) {
+	outPath, err := resolveOutPath(fileInfo, outDir, sortIntoCategories, dateTaken, category, false)
 	if err != nil {
-		return "", fmt.Errorf("construct out path for %s: %v", fileName, err)
+		return "", err
 	}
 
-	fileContent, err := os.ReadFile(path.Join(sourceDir, fileName))
+	fileContent, err := os.ReadFile(path.Join(sourceDir, fileInfo.Name()))
 	if err != nil {
-		return "", fmt.Errorf("read file %s: %v", fileName, err)
+		return "", fmt.Errorf("read file %s: %v", fileInfo.Name(), err)
 	}
 
 	if err := os.WriteFile(outPath, fileContent, 0644); err != nil {
-		return outPath, fmt.Errorf("write file %s: %v", fileName, err)
+		return outPath, fmt.Errorf("write file %s: %v", fileInfo.Name(), err)
 	}
 
 	return outPath, nil
 }
 
-func getFileCreatedDateTime(fileInfo fs.FileInfo, fileDir string) time.Time {
-	// First try to get the date taken from the EXIF data
-	dateTaken, err := getExifDateTaken(path.Join(fileDir, fileInfo.Name()))
-	if err == nil {
-		// Ignore the error and return the date taken if it was successfully retrieved
-		return dateTaken
-	}
+// resolveOutPath computes the YYYY-MM/<category>/filename path for
+// fileInfo, using the already-resolved dateTaken and category rather
+// than re-deriving them. When dryRun is true, it skips creating the
+// intermediate directories, so it can be called purely to preview a
+// plan.
+func resolveOutPath(fileInfo fs.FileInfo, outDir string, sortIntoCategories bool, dateTaken time.Time, category string, dryRun bool) (string, error) {
+	fileName := fileInfo.Name()
+	log.Printf("file %s created on %d-%02d-%02d", fileName, dateTaken.Year(), dateTaken.Month(), dateTaken.Day())
 
-	// If the EXIF data is not available, try to get the date taken from the file name
-	dateTaken, err = getDateTakenFromFileName(fileInfo.Name())
-	if err == nil {
-		return dateTaken
+	// Put files into subdirectories on the format YYYY-MM
+	monthDir := path.Join(outDir, fmt.Sprintf("%d-%02d", dateTaken.Year(), dateTaken.Month()))
+	if !dryRun {
+		if err := createDirIfNotExists(monthDir); err != nil {
+			return "", fmt.Errorf("create month directory %s: %v", monthDir, err)
+		}
 	}
 
-	// If we can't get the date from EXIF or the file name, fall back to get the file's modified time on disk.
-	// This will most likely be the datetime for when the file was copied to this hard drive instead of when the picture was actually taken (unfortunately).
-	created := fileInfo.ModTime()
-
-	if runtime.GOOS == "windows" {
-		// On Windows, we can get the file creation time from the file attributes
-		attr := fileInfo.Sys().(*syscall.Win32FileAttributeData)
-		created = time.Unix(0, attr.CreationTime.Nanoseconds())
+	outPath, err := constructOutPath(monthDir, fileName, sortIntoCategories, category, dryRun)
+	if err != nil {
+		return "", fmt.Errorf("construct out path for %s: %v", fileName, err)
 	}
 
-	return created
+	return outPath, nil
 }
 
 func getDateTakenFromFileName(fileName string) (time.Time, error) {
 	// Getting the date the picture was taken from the file name is a hail mary since if the camera follows a date format, it most likely also writes the date to the EXIF data.
 	// But in a rare case where we couldn't get the EXIF data, we can try to parse the date from the file name as a fallback.
-	for _, format := range fileDateTimeFormats {
-		dateTaken, err := time.Parse(format, fileName)
-		if err == nil {
-			log.Printf("parsed date taken %s from file name %s", dateTaken, fileName)
-			return dateTaken, nil
+	for _, p := range fileNameDatePatterns {
+		match := p.pattern.FindString(fileName)
+		if match == "" {
+			continue
+		}
+
+		if p.normalize != nil {
+			match = p.normalize(match)
 		}
+
+		dateTaken, err := time.Parse(p.layout, match)
+		if err != nil || !isPlausibleDateTaken(dateTaken) {
+			continue
+		}
+
+		log.Printf("parsed date taken %s from file name %s", dateTaken, fileName)
+		return dateTaken, nil
 	}
 
-	return time.Time{}, fmt.Errorf("no date taken found in file name")
+	return time.Time{}, fmt.Errorf("no date taken found in file name %s", fileName)
+}
+
+// isPlausibleDateTaken rejects dates outside a sane range, so a random
+// digit run that happens to match one of the patterns above (e.g. a
+// serial number) doesn't get parsed into a bogus date taken.
+func isPlausibleDateTaken(t time.Time) bool {
+	return t.Year() >= 1990 && t.Year() <= time.Now().Year()+1
 }
 
 func getExifDateTaken(filePath string) (time.Time, error) {
@@ -231,26 +264,20 @@ func getExifDateTaken(filePath string) (time.Time, error) {
 	return dateTaken, nil
 }
 
-func constructOutPath(parentPath string, fileName string, sortIntoCategories bool) (string, error) {
+func constructOutPath(parentPath string, fileName string, sortIntoCategories bool, category string, dryRun bool) (string, error) {
 	outPath := path.Join(parentPath, fileName)
 
 	if sortIntoCategories {
 		categoryDir := outPath
 
-		if isPicture(fileName) {
-			categoryDir = path.Join(parentPath, PicturesDirName)
-		}
-
-		if isVideo(fileName) {
-			categoryDir = path.Join(parentPath, VideosDirName)
-		}
-
-		if isGif(fileName) {
-			categoryDir = path.Join(parentPath, GifsDirName)
+		if category != "" {
+			categoryDir = path.Join(parentPath, category)
 		}
 
-		if err := createDirIfNotExists(categoryDir); err != nil {
-			return "", fmt.Errorf("create category directory %s: %v", categoryDir, err)
+		if !dryRun {
+			if err := createDirIfNotExists(categoryDir); err != nil {
+				return "", fmt.Errorf("create category directory %s: %v", categoryDir, err)
+			}
 		}
 
 		outPath = path.Join(categoryDir, fileName)
@@ -259,58 +286,6 @@ func constructOutPath(parentPath string, fileName string, sortIntoCategories boo
 	return outPath, nil
 }
 
-func preserveOriginalFileCreationDate(fileInfo os.FileInfo, filePath string) error {
-	createdTime := getFileCreatedDateTime(fileInfo, filePath)
-
-	if runtime.GOOS == "windows" {
-		return setWindowsFileCreationDateTime(filePath, createdTime)
-	}
-
-	modifiedTime := createdTime
-	accessTime := createdTime
-
-	if err := os.Chtimes(filePath, accessTime, modifiedTime); err != nil {
-		return fmt.Errorf("set file %s modification time: %v", fileInfo.Name(), err)
-	}
-
-	return nil
-}
-
-// setWindowsFileCreationDateTime sets the creation time of a file on Windows using Windows APIs via syscall.
-func setWindowsFileCreationDateTime(filename string, ctime time.Time) error {
-	// Convert the filename to a UTF16 pointer
-	filePath, err := syscall.UTF16PtrFromString(filename)
-	if err != nil {
-		return fmt.Errorf("resolve filePath from filename %s: %v", filename, err)
-	}
-
-	// Open the file with proper permissions to modify the file times
-	handle, err := syscall.CreateFile(
-		filePath,
-		syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_WRITE, nil,
-		syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
-
-	if err != nil {
-		return fmt.Errorf("open file %v: %v", *filePath, err)
-	}
-	defer func() {
-		if err := syscall.CloseHandle(handle); err != nil {
-			log.Fatalf("close syscall filehandler for %s: %v", filename, err)
-		}
-	}()
-
-	// Create a Filetime structure from the Go time
-	fileTime := syscall.NsecToFiletime(ctime.UnixNano())
-
-	// Set the creation time (leaving access and write times as nil will not modify them)
-	err = syscall.SetFileTime(handle, &fileTime, nil, nil)
-	if err != nil {
-		return fmt.Errorf("update file time for %s to %+v: %v", filename, fileTime, err)
-	}
-
-	return nil
-}
-
 func shouldBeSorted(fileName string, allowedExtensions []string) bool {
 	if len(allowedExtensions) == 1 && allowedExtensions[0] == "*" {
 		return true
@@ -356,6 +331,28 @@ func dirExists(path string) bool {
 	return true
 }
 
+// dirContains reports whether candidate is equal to or nested inside dir,
+// comparing absolute paths so relative arguments and trailing slashes
+// don't affect the result.
+func dirContains(dir string, candidate string) (bool, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, fmt.Errorf("resolve absolute path for %s: %v", dir, err)
+	}
+
+	absCandidate, err := filepath.Abs(candidate)
+	if err != nil {
+		return false, fmt.Errorf("resolve absolute path for %s: %v", candidate, err)
+	}
+
+	rel, err := filepath.Rel(absDir, absCandidate)
+	if err != nil {
+		return false, fmt.Errorf("resolve relative path from %s to %s: %v", absDir, absCandidate, err)
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))), nil
+}
+
 func createDirIfNotExists(path string) error {
 	err := os.Mkdir(path, 0777)
 	if err == nil {
@@ -376,33 +373,3 @@ func createDirIfNotExists(path string) error {
 
 	return err
 }
-
-func isPicture(fileName string) bool {
-	normalizedFileName := strings.ToLower(fileName)
-	for _, ext := range pictureFileExtensions {
-		if strings.HasSuffix(normalizedFileName, ext) {
-			return true
-		}
-	}
-	return false
-}
-
-func isVideo(fileName string) bool {
-	normalizedFileName := strings.ToLower(fileName)
-	for _, ext := range videoFileExtensions {
-		if strings.HasSuffix(normalizedFileName, ext) {
-			return true
-		}
-	}
-	return false
-}
-
-func isGif(fileName string) bool {
-	normalizedFileName := strings.ToLower(fileName)
-	for _, ext := range gifFileExtensions {
-		if strings.HasSuffix(normalizedFileName, ext) {
-			return true
-		}
-	}
-	return false
-}
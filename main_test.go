@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetDateTakenFromFileName(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+		want     time.Time
+		wantErr  bool
+	}{
+		{
+			name:     "android camera underscore format",
+			fileName: "IMG_20230515_142530.jpg",
+			want:     time.Date(2023, 5, 15, 14, 25, 30, 0, time.UTC),
+		},
+		{
+			name:     "macOS screenshot with dot-separated time",
+			fileName: "Screenshot 2023-05-15 14.30.25.png",
+			want:     time.Date(2023, 5, 15, 14, 30, 25, 0, time.UTC),
+		},
+		{
+			name:     "pixel camera format",
+			fileName: "PXL_20230515_142530123.jpg",
+			want:     time.Date(2023, 5, 15, 14, 25, 30, 0, time.UTC),
+		},
+		{
+			name:     "date with colon-separated time",
+			fileName: "2023-05-15 14:25:30.jpg",
+			want:     time.Date(2023, 5, 15, 14, 25, 30, 0, time.UTC),
+		},
+		{
+			name:     "date with dash-separated time",
+			fileName: "2023-05-15_14-25-30.jpg",
+			want:     time.Date(2023, 5, 15, 14, 25, 30, 0, time.UTC),
+		},
+		{
+			name:     "date only, no time",
+			fileName: "2023-05-15.jpg",
+			want:     time.Date(2023, 5, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "bare 8-digit date",
+			fileName: "20230515.jpg",
+			want:     time.Date(2023, 5, 15, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "no embedded date",
+			fileName: "vacation-photo.jpg",
+			wantErr:  true,
+		},
+		{
+			name:     "digit run that looks like a date but isn't plausible",
+			fileName: "IMG_00010101_000000.jpg",
+			wantErr:  true,
+		},
+		{
+			name:     "serial number rejected by implausible year",
+			fileName: "DSC99999999.jpg",
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getDateTakenFromFileName(tc.fileName)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("getDateTakenFromFileName(%q) = %v, want error", tc.fileName, got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("getDateTakenFromFileName(%q) returned error: %v", tc.fileName, err)
+			}
+			if !got.Equal(tc.want) {
+				t.Errorf("getDateTakenFromFileName(%q) = %v, want %v", tc.fileName, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsPlausibleDateTaken(t *testing.T) {
+	tests := []struct {
+		name string
+		t    time.Time
+		want bool
+	}{
+		{name: "well within range", t: time.Date(2023, 5, 15, 0, 0, 0, 0, time.UTC), want: true},
+		{name: "earliest plausible year", t: time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC), want: true},
+		{name: "before earliest plausible year", t: time.Date(1989, 12, 31, 0, 0, 0, 0, time.UTC), want: false},
+		{name: "next year is still plausible", t: time.Date(time.Now().Year()+1, 1, 1, 0, 0, 0, 0, time.UTC), want: true},
+		{name: "two years out is not plausible", t: time.Date(time.Now().Year()+2, 1, 1, 0, 0, 0, 0, time.UTC), want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isPlausibleDateTaken(tc.t); got != tc.want {
+				t.Errorf("isPlausibleDateTaken(%v) = %v, want %v", tc.t, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Media describes a single source file that has been parsed enough to
+// know when it was taken, what category it belongs in, and how to place
+// itself in the output directory. Each supported format gets its own
+// concrete type so format-specific metadata (EXIF, PNG text chunks,
+// QuickTime atoms, ...) stays isolated from the generic copy/link
+// mechanics in copyFile and copyFileContentAddressed.
+type Media interface {
+	DateTaken() time.Time
+	Category() string
+	Move(outDir string) error
+}
+
+// baseMedia holds everything every concrete Media type needs to resolve
+// its date taken and place itself in outDir: the source path and file
+// info, the date taken and where it came from, and the sort mode chosen
+// for this run.
+type baseMedia struct {
+	path               string
+	info               fs.FileInfo
+	sourceDir          string
+	sortIntoCategories bool
+	contentAddressed   bool
+	template           string
+	category           string
+	dateTaken          time.Time
+	dateSource         string
+	dryRun             bool
+	manifest           *manifestRecorder
+}
+
+func (m baseMedia) DateTaken() time.Time { return m.dateTaken }
+func (m baseMedia) Category() string     { return m.category }
+
+// move performs the actual copy/link into outDir, shared by every
+// concrete Media type's Move method. In -dryrun mode it computes the
+// same target path without touching the filesystem.
+func (m baseMedia) move(outDir string) error {
+	if m.dryRun {
+		return m.planMove(outDir)
+	}
+
+	fileName := m.info.Name()
+	log.Printf("copying file %s", fileName)
+
+	var outPath string
+	var err error
+	switch {
+	case m.contentAddressed:
+		outPath, err = copyFileContentAddressed(m.info, m.sourceDir, outDir, m.dateTaken)
+	case m.template != "":
+		outPath, err = copyFileWithTemplate(m.sourceDir, fileName, outDir, m.template, m.category, m.dateTaken)
+	default:
+		outPath, err = copyFile(m.info, m.sourceDir, outDir, m.sortIntoCategories, m.dateTaken, m.category)
+	}
+
+	var dupErr *DupError
+	if errors.As(err, &dupErr) {
+		log.Printf("file %s: %v", fileName, dupErr)
+	} else if err != nil {
+		return fmt.Errorf("copy file %s: %v", fileName, err)
+	}
+
+	if err := setFileDateTaken(outPath, m.dateTaken); err != nil {
+		return fmt.Errorf("set date taken on %s: %v", fileName, err)
+	}
+
+	log.Printf("file %s copied to %s", fileName, outPath)
+	return nil
+}
+
+// setFileDateTaken stamps the copied file at outPath with dateTaken: its
+// mtime/atime everywhere, and on Windows its creation time too, so the
+// resolved date taken survives in whichever attribute a user's file
+// browser or later tooling happens to sort by.
+func setFileDateTaken(outPath string, dateTaken time.Time) error {
+	if err := os.Chtimes(outPath, dateTaken, dateTaken); err != nil {
+		return fmt.Errorf("set modification time: %v", err)
+	}
+
+	if runtime.GOOS == "windows" {
+		return setWindowsFileCreationDateTime(outPath, dateTaken)
+	}
+
+	return nil
+}
+
+// setWindowsFileCreationDateTime sets the creation time of a file on Windows using Windows APIs via syscall.
+func setWindowsFileCreationDateTime(filename string, ctime time.Time) error {
+	// Convert the filename to a UTF16 pointer
+	filePath, err := syscall.UTF16PtrFromString(filename)
+	if err != nil {
+		return fmt.Errorf("resolve filePath from filename %s: %v", filename, err)
+	}
+
+	// Open the file with proper permissions to modify the file times
+	handle, err := syscall.CreateFile(
+		filePath,
+		syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_WRITE, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+
+	if err != nil {
+		return fmt.Errorf("open file %v: %v", *filePath, err)
+	}
+	defer func() {
+		if err := syscall.CloseHandle(handle); err != nil {
+			log.Fatalf("close syscall filehandler for %s: %v", filename, err)
+		}
+	}()
+
+	// Create a Filetime structure from the Go time
+	fileTime := syscall.NsecToFiletime(ctime.UnixNano())
+
+	// Set the creation time (leaving access and write times as nil will not modify them)
+	err = syscall.SetFileTime(handle, &fileTime, nil, nil)
+	if err != nil {
+		return fmt.Errorf("update file time for %s to %+v: %v", filename, fileTime, err)
+	}
+
+	return nil
+}
+
+// JPEG, HEIC, DNG and ARW all carry EXIF metadata, decoded via goexif.
+type JPEG struct{ baseMedia }
+type HEIC struct{ baseMedia }
+type DNG struct{ baseMedia }
+type ARW struct{ baseMedia }
+
+// PNG reads its date taken from a tEXt "Creation Time" chunk, if present.
+type PNG struct{ baseMedia }
+
+// MP4 and MOV read their date taken from the moov/mvhd atom.
+type MP4 struct{ baseMedia }
+type MOV struct{ baseMedia }
+
+// GIF has no standard embedded metadata, so it falls back to filename
+// parsing and then mtime, same as any unrecognized extension.
+type GIF struct{ baseMedia }
+
+// WebP has no standard embedded metadata either, so it falls back the
+// same way as GIF. It's filed under VideosDirName since animated WebPs
+// are the common case this tool sorts.
+type WebP struct{ baseMedia }
+
+// Unknown is used for extensions with no dedicated handling. It falls
+// back to filename parsing and then mtime, same as GIF.
+type Unknown struct{ baseMedia }
+
+func (m *JPEG) Move(outDir string) error    { return m.move(outDir) }
+func (m *HEIC) Move(outDir string) error    { return m.move(outDir) }
+func (m *DNG) Move(outDir string) error     { return m.move(outDir) }
+func (m *ARW) Move(outDir string) error     { return m.move(outDir) }
+func (m *PNG) Move(outDir string) error     { return m.move(outDir) }
+func (m *MP4) Move(outDir string) error     { return m.move(outDir) }
+func (m *MOV) Move(outDir string) error     { return m.move(outDir) }
+func (m *GIF) Move(outDir string) error     { return m.move(outDir) }
+func (m *WebP) Move(outDir string) error    { return m.move(outDir) }
+func (m *Unknown) Move(outDir string) error { return m.move(outDir) }
+
+// parseMediaOptions bundles the per-run settings parseMedia needs, beyond
+// the file itself, so its signature doesn't keep growing with each new
+// flag.
+type parseMediaOptions struct {
+	sortIntoCategories bool
+	contentAddressed   bool
+	template           string
+	dryRun             bool
+	manifest           *manifestRecorder
+}
+
+// parseMedia dispatches on path's lowercased extension and returns the
+// concrete Media type that knows how to read that format's metadata.
+func parseMedia(path string, info fs.FileInfo, sourceDir string, opts parseMediaOptions) Media {
+	base := baseMedia{
+		path:               path,
+		info:               info,
+		sourceDir:          sourceDir,
+		sortIntoCategories: opts.sortIntoCategories,
+		contentAddressed:   opts.contentAddressed,
+		template:           opts.template,
+		dryRun:             opts.dryRun,
+		manifest:           opts.manifest,
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		base.category = PicturesDirName
+		base.dateTaken, base.dateSource = exifDateTaken(path, info)
+		return &JPEG{base}
+	case ".heic":
+		base.category = PicturesDirName
+		base.dateTaken, base.dateSource = exifDateTaken(path, info)
+		return &HEIC{base}
+	case ".dng":
+		base.category = PicturesDirName
+		base.dateTaken, base.dateSource = exifDateTaken(path, info)
+		return &DNG{base}
+	case ".arw":
+		base.category = PicturesDirName
+		base.dateTaken, base.dateSource = exifDateTaken(path, info)
+		return &ARW{base}
+	case ".png":
+		base.category = PicturesDirName
+		base.dateTaken, base.dateSource = pngDateTaken(path, info)
+		return &PNG{base}
+	case ".mp4":
+		base.category = VideosDirName
+		base.dateTaken, base.dateSource = quicktimeDateTaken(path, info)
+		return &MP4{base}
+	case ".mov":
+		base.category = VideosDirName
+		base.dateTaken, base.dateSource = quicktimeDateTaken(path, info)
+		return &MOV{base}
+	case ".gif":
+		base.category = GifsDirName
+		base.dateTaken, base.dateSource = fallbackDateTaken(info)
+		return &GIF{base}
+	case ".webp":
+		base.category = VideosDirName
+		base.dateTaken, base.dateSource = fallbackDateTaken(info)
+		return &WebP{base}
+	default:
+		base.dateTaken, base.dateSource = fallbackDateTaken(info)
+		return &Unknown{base}
+	}
+}
+
+// exifDateTaken resolves a date taken from EXIF data, falling back to
+// filename parsing and then mtime if EXIF is missing or unreadable.
+func exifDateTaken(path string, info fs.FileInfo) (time.Time, string) {
+	if t, err := getExifDateTaken(path); err == nil {
+		return t, "exif"
+	}
+	return fallbackDateTaken(info)
+}
+
+// fallbackDateTaken tries to parse a date out of the filename, then falls
+// back to the file's modification (or, on Windows, creation) time.
+func fallbackDateTaken(info fs.FileInfo) (time.Time, string) {
+	if t, err := getDateTakenFromFileName(info.Name()); err == nil {
+		return t, "filename"
+	}
+
+	if runtime.GOOS == "windows" {
+		attr := info.Sys().(*syscall.Win32FileAttributeData)
+		return time.Unix(0, attr.CreationTime.Nanoseconds()), "ctime"
+	}
+
+	return info.ModTime(), "mtime"
+}
+
+// maxMetadataChunkSize bounds how large a single PNG chunk or MP4/MOV
+// atom payload we'll trust enough to allocate for. A truncated or
+// corrupted file (not uncommon after an interrupted camera transfer) can
+// put an arbitrary value in its length field; without a sane upper bound
+// that gets read straight into a make([]byte, ...), so anything claiming
+// to be bigger than this is treated as corrupt instead.
+const maxMetadataChunkSize = 64 << 20 // 64 MiB
+
+// pngDateTaken reads the "Creation Time" tEXt chunk that some encoders
+// (e.g. ImageMagick, macOS screenshots) write into PNG files, falling
+// back to filename parsing and then mtime.
+func pngDateTaken(path string, info fs.FileInfo) (time.Time, string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fallbackDateTaken(info)
+	}
+	defer f.Close()
+
+	sig := make([]byte, 8)
+	if _, err := io.ReadFull(f, sig); err != nil {
+		return fallbackDateTaken(info)
+	}
+
+	for {
+		var length uint32
+		if err := binary.Read(f, binary.BigEndian, &length); err != nil {
+			break
+		}
+
+		chunkType := make([]byte, 4)
+		if _, err := io.ReadFull(f, chunkType); err != nil {
+			break
+		}
+
+		if length > maxMetadataChunkSize {
+			break
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(f, data); err != nil {
+			break
+		}
+
+		if _, err := f.Seek(4, io.SeekCurrent); err != nil { // skip CRC
+			break
+		}
+
+		if string(chunkType) == "tEXt" {
+			if t, ok := parsePNGCreationTime(data); ok {
+				return t, "png"
+			}
+		}
+
+		if string(chunkType) == "IEND" {
+			break
+		}
+	}
+
+	return fallbackDateTaken(info)
+}
+
+func parsePNGCreationTime(chunk []byte) (time.Time, bool) {
+	parts := bytes.SplitN(chunk, []byte{0}, 2)
+	if len(parts) != 2 || string(parts[0]) != "Creation Time" {
+		return time.Time{}, false
+	}
+
+	value := string(parts[1])
+	for _, layout := range []string{time.ANSIC, time.RFC1123, "Mon Jan 2 15:04:05 2006"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// quicktimeEpoch is the QuickTime/MP4 reference time: seconds in an
+// mvhd atom are counted from 1904-01-01 UTC, not the Unix epoch.
+var quicktimeEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// quicktimeDateTaken reads the creation time out of the moov/mvhd atom
+// shared by the MP4 and QuickTime MOV container formats, falling back
+// to filename parsing and then mtime.
+func quicktimeDateTaken(path string, info fs.FileInfo) (time.Time, string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fallbackDateTaken(info)
+	}
+	defer f.Close()
+
+	mvhd, err := findChildAtom(f, "moov", "mvhd")
+	if err != nil || len(mvhd) < 8 {
+		return fallbackDateTaken(info)
+	}
+
+	version := mvhd[0]
+	var creationSeconds uint64
+	if version == 1 {
+		if len(mvhd) < 12 {
+			return fallbackDateTaken(info)
+		}
+		creationSeconds = binary.BigEndian.Uint64(mvhd[4:12])
+	} else {
+		creationSeconds = uint64(binary.BigEndian.Uint32(mvhd[4:8]))
+	}
+
+	return quicktimeEpoch.Add(time.Duration(creationSeconds) * time.Second), "quicktime"
+}
+
+// findChildAtom walks top-level QuickTime/MP4 atoms in r looking for
+// container, then returns the raw payload of the first atom named child
+// nested directly inside it (e.g. container "moov", child "mvhd").
+func findChildAtom(r io.ReadSeeker, container string, child string) ([]byte, error) {
+	for {
+		size, typ, err := readAtomHeader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s atom not found", container)
+		}
+		if size < 8 || size > maxMetadataChunkSize {
+			return nil, fmt.Errorf("%s atom has invalid size %d", container, size)
+		}
+
+		if typ != container {
+			if _, err := r.Seek(int64(size)-8, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		containerEnd, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		containerEnd += int64(size) - 8
+
+		for {
+			pos, err := r.Seek(0, io.SeekCurrent)
+			if err != nil || pos >= containerEnd {
+				return nil, fmt.Errorf("%s atom not found in %s", child, container)
+			}
+
+			childSize, childType, err := readAtomHeader(r)
+			if err != nil {
+				return nil, fmt.Errorf("%s atom not found in %s", child, container)
+			}
+			if childSize < 8 || childSize > maxMetadataChunkSize {
+				return nil, fmt.Errorf("%s atom in %s has invalid size %d", child, container, childSize)
+			}
+
+			if childType == child {
+				payload := make([]byte, childSize-8)
+				if _, err := io.ReadFull(r, payload); err != nil {
+					return nil, err
+				}
+				return payload, nil
+			}
+
+			if _, err := r.Seek(int64(childSize)-8, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func readAtomHeader(r io.Reader) (uint32, string, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	return binary.BigEndian.Uint32(header[:4]), string(header[4:8]), nil
+}
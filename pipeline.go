@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// Source recursively walks root and streams every regular file path it
+// finds onto the returned channel. Unlike a plain os.ReadDir of the top
+// level, this also descends into nested source directories.
+func Source(root string) <-chan string {
+	out := make(chan string)
+
+	go func() {
+		defer close(out)
+
+		err := filepath.Walk(root, func(p string, info fs.FileInfo, err error) error {
+			if err != nil {
+				log.Printf("ERROR: walk %s: %v", p, err)
+				return nil
+			}
+
+			if info.IsDir() {
+				return nil
+			}
+
+			out <- p
+			return nil
+		})
+
+		if err != nil {
+			log.Printf("ERROR: walk %s: %v", root, err)
+		}
+	}()
+
+	return out
+}
+
+// Parse reads each incoming file path and dispatches it to parseMedia,
+// emitting the resulting Media value. It runs its own worker pool sized
+// for the I/O-bound work of opening files and reading embedded metadata.
+// lim may be nil, meaning unlimited.
+func Parse(paths <-chan string, fileExtensions []string, opts parseMediaOptions, lim *limiter) <-chan Media {
+	out := make(chan Media)
+
+	var wg sync.WaitGroup
+	numWorkers := runtime.NumCPU()
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for p := range paths {
+				fileName := filepath.Base(p)
+
+				if !shouldBeSorted(fileName, fileExtensions) {
+					log.Printf("file %s does not match allowed file extensions %+v, skipping", fileName, fileExtensions)
+					continue
+				}
+
+				if !lim.allow() {
+					continue
+				}
+
+				info, err := os.Stat(p)
+				if err != nil {
+					log.Printf("ERROR: stat file %s: %v", p, err)
+					continue
+				}
+
+				out <- parseMedia(p, info, filepath.Dir(p), opts)
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
+// Move places each parsed Media item into outDir and reports any failure
+// on the returned error channel. It runs its own worker pool sized for
+// the CPU-bound work of copying file content.
+func Move(media <-chan Media, outDir string) <-chan error {
+	errs := make(chan error)
+
+	var wg sync.WaitGroup
+	numWorkers := runtime.NumCPU()
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for m := range media {
+				if err := m.Move(outDir); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(errs)
+	}()
+
+	return errs
+}
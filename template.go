@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// strftimeTokens maps the strftime-style date tokens this tool accepts in
+// a -template pattern to Go's reference-time layout equivalents.
+var strftimeTokens = []struct {
+	token  string
+	layout string
+}{
+	{"%Y", "2006"},
+	{"%y", "06"},
+	{"%m", "01"},
+	{"%d", "02"},
+	{"%H", "15"},
+	{"%M", "04"},
+	{"%S", "05"},
+}
+
+// toTimeFormat translates a strftime-style pattern such as
+// "%Y/%m/%d-%H%M%S" into a Go time.Format layout. Custom placeholders
+// (%category, %ext, %name, %hash) are left untouched so they can be
+// substituted afterwards, once the date portion has been formatted.
+func toTimeFormat(pattern string) string {
+	layout := pattern
+	for _, tok := range strftimeTokens {
+		layout = strings.ReplaceAll(layout, tok.token, tok.layout)
+	}
+	return layout
+}
+
+// renderTemplate expands a -template pattern for a single file: the date
+// tokens are formatted against dateTaken first, then %category, %ext,
+// %name and %hash are substituted with the file's actual values.
+func renderTemplate(pattern string, dateTaken time.Time, category string, srcPath string) (string, error) {
+	rendered := dateTaken.Format(toTimeFormat(pattern))
+
+	fileName := filepath.Base(srcPath)
+	ext := strings.ToLower(filepath.Ext(fileName))
+	name := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+
+	rendered = strings.ReplaceAll(rendered, "%category", category)
+	rendered = strings.ReplaceAll(rendered, "%ext", ext)
+	rendered = strings.ReplaceAll(rendered, "%name", name)
+
+	if strings.Contains(rendered, "%hash") {
+		hash, err := hashFile(srcPath)
+		if err != nil {
+			return "", fmt.Errorf("hash file %s: %v", srcPath, err)
+		}
+		rendered = strings.ReplaceAll(rendered, "%hash", hash)
+	}
+
+	return rendered, nil
+}
+
+// templateCollisionCounts tracks, per rendered target path, how many
+// times that exact path has already been claimed during this run, so a
+// second file that resolves to the same template target gets a _NNNN
+// suffix appended before the extension instead of clobbering the first.
+var templateCollisionCounts = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: map[string]int{}}
+
+// uniqueTemplatePath returns renderedPath, or renderedPath with a
+// _NNNN counter inserted before its extension if that path is already
+// taken, either earlier in this run or on disk from a previous run.
+func uniqueTemplatePath(renderedPath string) string {
+	ext := path.Ext(renderedPath)
+	base := strings.TrimSuffix(renderedPath, ext)
+
+	templateCollisionCounts.Lock()
+	defer templateCollisionCounts.Unlock()
+
+	n := templateCollisionCounts.counts[renderedPath]
+	for {
+		candidate := renderedPath
+		if n > 0 {
+			candidate = fmt.Sprintf("%s_%04d%s", base, n, ext)
+		}
+
+		if !FileExists(candidate) {
+			templateCollisionCounts.counts[renderedPath] = n + 1
+			return candidate
+		}
+
+		n++
+	}
+}
+
+// planTemplatePath renders outDir's -template pattern for fileName and
+// resolves it to a collision-free path, without touching the filesystem
+// beyond the read-only checks uniqueTemplatePath and %hash need.
+func planTemplatePath(sourceDir string, fileName string, outDir string, pattern string, category string, dateTaken time.Time) (string, error) {
+	srcPath := path.Join(sourceDir, fileName)
+
+	rendered, err := renderTemplate(pattern, dateTaken, category, srcPath)
+	if err != nil {
+		return "", fmt.Errorf("render template for %s: %v", fileName, err)
+	}
+
+	return uniqueTemplatePath(path.Join(outDir, rendered)), nil
+}
+
+// copyFileWithTemplate renders outDir's -template pattern for fileName
+// and writes the file there, creating any intermediate directories the
+// pattern implies.
+func copyFileWithTemplate(sourceDir string, fileName string, outDir string, pattern string, category string, dateTaken time.Time) (string, error) {
+	srcPath := path.Join(sourceDir, fileName)
+
+	outPath, err := planTemplatePath(sourceDir, fileName, outDir, pattern, category, dateTaken)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(path.Dir(outPath), 0777); err != nil {
+		return "", fmt.Errorf("create template output directory for %s: %v", outPath, err)
+	}
+
+	fileContent, err := os.ReadFile(srcPath)
+	if err != nil {
+		return "", fmt.Errorf("read file %s: %v", fileName, err)
+	}
+
+	if err := os.WriteFile(outPath, fileContent, 0644); err != nil {
+		return outPath, fmt.Errorf("write file %s: %v", outPath, err)
+	}
+
+	return outPath, nil
+}